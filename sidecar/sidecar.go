@@ -15,8 +15,12 @@ package sidecar
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -32,6 +36,8 @@ import (
 
 type UpdateConfigCmd struct {
 	Yaml string `json:"yaml"`
+	// Author 是提交本次变更的用户或系统，可为空；会被记录进配置历史，供 ListRevisions 展示
+	Author string `json:"author,omitempty"`
 }
 
 func (cmd *UpdateConfigCmd) Validate(logger log.Logger) errs.ValidateErrors {
@@ -61,28 +67,108 @@ func (cmd *UpdateConfigCmd) ParseConfig() (*bbconfig.Config, error) {
 	return c, nil
 }
 
+// SidecarService 里除 UpdateConfigReload 之外的方法都还没有对应的 HTTP handler：本仓库这份
+// 快照里找不到暴露 UpdateConfigReload 的 transport 层代码（没有 handler/router/main 之类的
+// 文件）可供参照，没法比着加路由。要把它们暴露给操作者调用，需要在持有 transport 层代码的那
+// 部分仓库里接线。
 type SidecarService interface {
 	// UpdateConfigReload 更新 Prometheus 配置文件，并且指示 Prometheus reload
 	UpdateConfigReload(ctx context.Context, cmd *UpdateConfigCmd, reloadCh chan chan error) error
+	// PutModule 新增或更新单个 module 配置（而不是整份 YAML），并且指示 Blackbox reload，
+	// 便于多个调用方在不互相覆盖对方修改的前提下共享同一个 blackbox 实例
+	PutModule(ctx context.Context, name string, moduleYaml string, reloadCh chan chan error) error
+	// DeleteModule 删除单个 module 配置，并且指示 Blackbox reload；如果该 module 本就不存在，
+	// 视为幂等操作，不返回错误
+	DeleteModule(ctx context.Context, name string, reloadCh chan chan error) error
 	// GetLastUpdateTs 获得上一次更新配置文件的时间
 	GetLastUpdateTs() time.Time
+	// ListRevisions 列出配置文件的历史版本，最新的排在最前面
+	ListRevisions(ctx context.Context) []RevisionInfo
+	// GetRevision 获取指定历史版本的完整 YAML 内容
+	GetRevision(ctx context.Context, sha string) (string, error)
+	// Rollback 把配置文件回滚到指定的历史版本，并且指示 Blackbox reload；回滚本身也会作为
+	// 一条新的历史记录被追加，历史因此是只追加（append-only）的
+	Rollback(ctx context.Context, sha string, reloadCh chan chan error) error
 }
 
+// RevisionInfo 是一条配置历史记录的元数据，不包含 YAML 内容本身（通过 GetRevision 单独获取）。
+type RevisionInfo struct {
+	Sha256    string    `json:"sha256"`
+	Timestamp time.Time `json:"timestamp"`
+	Author    string    `json:"author"`
+}
+
+const (
+	// defaultHistoryDepth 是配置历史环形缓冲区的默认长度
+	defaultHistoryDepth = 10
+	// historyDirName 是配置历史快照的存放目录，与 configFile 同级
+	historyDirName = "blackbox.history"
+	// historyIndexFile 记录历史快照的顺序和元数据，使历史在重启后仍然可用
+	historyIndexFile = "index.json"
+)
+
 func New(logger log.Logger, configFile string) SidecarService {
+	return NewWithHistoryDepth(logger, configFile, defaultHistoryDepth)
+}
+
+// NewWithHistoryDepth 和 New 一样，但允许调整配置历史环形缓冲区保留的版本数。
+func NewWithHistoryDepth(logger log.Logger, configFile string, historyDepth int) SidecarService {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
-	return &sidecarService{
-		logger:     logger,
-		configFile: configFile,
+	if historyDepth <= 0 {
+		historyDepth = defaultHistoryDepth
 	}
+
+	// historyDir 固定挂在 configFile 本身所在的目录下，而不是 configFile 当前指向的目录
+	// （两者何时不同见 sidecarService.configFile 上的注释），这样 history 不会跟着符号链接的
+	// 重新指向而漂到一个迟早被回收的旧目录里。
+	s := &sidecarService{
+		logger:       logger,
+		configFile:   configFile,
+		writeFile:    os.WriteFile,
+		rename:       os.Rename,
+		historyDir:   filepath.Join(filepath.Dir(configFile), historyDirName),
+		historyDepth: historyDepth,
+	}
+
+	history, err := loadHistory(s.historyDir)
+	if err != nil {
+		level.Warn(logger).Log("err", errors.Wrapf(err, "Load config history error").Error())
+	}
+	s.history = history
+
+	return s
 }
 
 type sidecarService struct {
-	logger       log.Logger
+	logger log.Logger
+	// configFile 是调用方传入的原始路径，可能是个软链（k8s ConfigMap 挂载常见的 `..data/` 模式）；
+	// 每次写入都重新 filepath.EvalSymlinks 解析一次，而不是缓存解析结果，这样 kubelet 重新指向
+	// 新的时间戳目录之后，写入依然会落到当前真正生效的文件上。
 	configFile   string
 	lock         sync.Mutex
 	lastUpdateTs time.Time // 上一次更新配置文件的时间戳
+
+	// writeFile/rename 零值时在 writeConfigFile 里分别退化为 os.WriteFile/os.Rename，所以一个
+	// 零值的 sidecarService 是安全的；测试可以替换成会失败的实现，用来验证原子替换失败时旧文件
+	// 保持不变。
+	writeFile func(name string, data []byte, perm os.FileMode) error
+	rename    func(oldpath, newpath string) error
+
+	historyDir   string
+	historyDepth int
+	// 按时间顺序排列，最旧的在前；每次 recordRevision 之后长度不超过 historyDepth。启动时从磁盘
+	// 加载的历史不做截断，可能比一个更小的 historyDepth 长，直到下一次 recordRevision。
+	history []revisionRecord
+}
+
+// revisionRecord 是持久化到 historyIndexFile 里的一条历史记录元数据，YAML 内容单独存成
+// <sha256>.yaml，避免索引文件随着版本数增长而膨胀。
+type revisionRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Sha256    string    `json:"sha256"`
+	Author    string    `json:"author"`
 }
 
 func (s *sidecarService) GetLastUpdateTs() time.Time {
@@ -105,6 +191,134 @@ func (s *sidecarService) UpdateConfigReload(ctx context.Context, cmd *UpdateConf
 		return err
 	}
 
+	return s.applyConfigYaml(oldConfigYaml, cmd.Yaml, cmd.Author, reloadCh)
+}
+
+func (s *sidecarService) PutModule(ctx context.Context, name string, moduleYaml string, reloadCh chan chan error) error {
+	if strings.TrimSpace(name) == "" {
+		return errs.ValidateErrors{"Module name must not be blank"}
+	}
+	if err := validateModuleYaml(name, moduleYaml); err != nil {
+		return errs.ValidateErrors{errs.ValidateError(err.Error()).Prefix("Invalid Yaml: ")}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldConfigYaml, err := s.readConfigFile()
+	if err != nil {
+		return err
+	}
+
+	newConfigYaml, err := putModuleNode(oldConfigYaml, name, moduleYaml)
+	if err != nil {
+		return err
+	}
+
+	return s.applyConfigYaml(oldConfigYaml, newConfigYaml, "", reloadCh)
+}
+
+func (s *sidecarService) DeleteModule(ctx context.Context, name string, reloadCh chan chan error) error {
+	if strings.TrimSpace(name) == "" {
+		return errs.ValidateErrors{"Module name must not be blank"}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldConfigYaml, err := s.readConfigFile()
+	if err != nil {
+		return err
+	}
+
+	newConfigYaml, changed, err := deleteModuleNode(oldConfigYaml, name)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		// module 本就不存在，视为幂等操作
+		return nil
+	}
+
+	return s.applyConfigYaml(oldConfigYaml, newConfigYaml, "", reloadCh)
+}
+
+func (s *sidecarService) ListRevisions(ctx context.Context) []RevisionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	revisions := make([]RevisionInfo, 0, len(s.history))
+	for i := len(s.history) - 1; i >= 0; i-- {
+		r := s.history[i]
+		revisions = append(revisions, RevisionInfo{
+			Sha256:    r.Sha256,
+			Timestamp: r.Timestamp,
+			Author:    r.Author,
+		})
+	}
+	return revisions
+}
+
+func (s *sidecarService) GetRevision(ctx context.Context, sha string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.hasRevision(sha) {
+		return "", errors.Errorf("revision %q not found", sha)
+	}
+
+	data, err := os.ReadFile(s.revisionFile(sha))
+	if err != nil {
+		return "", errors.Wrapf(err, "Read revision %q failed", sha)
+	}
+	return string(data), nil
+}
+
+func (s *sidecarService) Rollback(ctx context.Context, sha string, reloadCh chan chan error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.hasRevision(sha) {
+		return errors.Errorf("revision %q not found", sha)
+	}
+
+	revisionYaml, err := os.ReadFile(s.revisionFile(sha))
+	if err != nil {
+		return errors.Wrapf(err, "Read revision %q failed", sha)
+	}
+
+	// 和 UpdateConfigReload 走一样的校验：磁盘上的历史快照可能是在更早的 bbconfig 版本下写入的
+	// （字段被改名/删除），或者文件本身已经损坏，回滚前必须过一遍和新提交 YAML 相同的 schema 检查
+	cmd := &UpdateConfigCmd{Yaml: string(revisionYaml)}
+	if verrs := cmd.Validate(s.logger); len(verrs) > 0 {
+		return verrs
+	}
+
+	oldConfigYaml, err := s.readConfigFile()
+	if err != nil {
+		return err
+	}
+
+	// 回滚本身也会在 applyConfigYaml 里被记录成一条新的历史记录，历史因此保持只追加
+	return s.applyConfigYaml(oldConfigYaml, cmd.Yaml, "rollback:"+sha, reloadCh)
+}
+
+func (s *sidecarService) hasRevision(sha string) bool {
+	for _, r := range s.history {
+		if r.Sha256 == sha {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sidecarService) revisionFile(sha string) string {
+	return filepath.Join(s.historyDir, sha+".yaml")
+}
+
+// applyConfigYaml 是 UpdateConfigReload/PutModule/DeleteModule/Rollback 共用的
+// 写入 -> reload -> 失败回滚 流程，调用方需要持有 s.lock。
+func (s *sidecarService) applyConfigYaml(oldConfigYaml, newConfigYaml, author string, reloadCh chan chan error) error {
 	var reloadErr error
 	defer func() {
 		if reloadErr != nil {
@@ -115,16 +329,90 @@ func (s *sidecarService) UpdateConfigReload(ctx context.Context, cmd *UpdateConf
 	}()
 
 	// 更新配置文件
-	if reloadErr = s.writeConfigFile(cmd.Yaml); reloadErr != nil {
+	if reloadErr = s.writeConfigFile(newConfigYaml); reloadErr != nil {
 		// 恢复旧文件
 		return reloadErr
 	}
 
 	// 指示 Blackbox reload 配置文件
-	if reloadErr = s.doReload(reloadCh); reloadErr == nil {
-		s.lastUpdateTs = time.Now()
+	if reloadErr = s.doReload(reloadCh); reloadErr != nil {
+		return reloadErr
+	}
+
+	s.lastUpdateTs = time.Now()
+	if err := s.recordRevision(newConfigYaml, author); err != nil {
+		// 历史记录失败不应该让本次已经成功的更新失败，只记日志
+		level.Error(s.logger).Log("err", errors.Wrapf(err, "Record config history error").Error())
+	}
+	return nil
+}
+
+// recordRevision 把 configYaml 的一份快照追加进历史环形缓冲区，超出 historyDepth 的最旧版本
+// 会被淘汰并从磁盘删除。
+func (s *sidecarService) recordRevision(configYaml, author string) error {
+	sum := sha256.Sum256([]byte(configYaml))
+	sha := hex.EncodeToString(sum[:])
+
+	if err := os.MkdirAll(s.historyDir, 0o755); err != nil {
+		return errors.Wrapf(err, "Create history dir %q failed", s.historyDir)
+	}
+	if err := s.writeFile(s.revisionFile(sha), []byte(configYaml), 0o644); err != nil {
+		return errors.Wrapf(err, "Write revision file for %q failed", sha)
+	}
+
+	s.history = append(s.history, revisionRecord{
+		Timestamp: time.Now(),
+		Sha256:    sha,
+		Author:    author,
+	})
+
+	var evicted []revisionRecord
+	if len(s.history) > s.historyDepth {
+		evicted = s.history[:len(s.history)-s.historyDepth]
+		s.history = s.history[len(s.history)-s.historyDepth:]
+	}
+
+	if err := saveHistoryIndex(s.historyDir, s.history); err != nil {
+		return errors.Wrap(err, "Save history index failed")
+	}
+
+	for _, old := range evicted {
+		// 历史是按 sha256 内容寻址存储的：如果同样的内容（比如 Rollback 重新提交了一份旧 YAML）
+		// 还有一条记录留在当前 history 里，那么快照文件仍然被引用，不能删，否则会删掉刚刚写入
+		// 的、恰好同名的快照。
+		if s.hasRevision(old.Sha256) {
+			continue
+		}
+		if err := os.Remove(s.revisionFile(old.Sha256)); err != nil && !os.IsNotExist(err) {
+			level.Warn(s.logger).Log("err", errors.Wrapf(err, "Remove evicted revision %q error", old.Sha256).Error())
+		}
+	}
+
+	return nil
+}
+
+func loadHistory(historyDir string) ([]revisionRecord, error) {
+	data, err := os.ReadFile(filepath.Join(historyDir, historyIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var history []revisionRecord
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func saveHistoryIndex(historyDir string, history []revisionRecord) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
 	}
-	return reloadErr
+	return os.WriteFile(filepath.Join(historyDir, historyIndexFile), data, 0o644)
 }
 
 func (s *sidecarService) readConfigFile() (string, error) {
@@ -135,14 +423,68 @@ func (s *sidecarService) readConfigFile() (string, error) {
 	return string(configYamlB), nil
 }
 
+// writeConfigFile 把 configYaml 原子地落盘到 s.configFile：先写到同目录下的临时文件并 fsync，
+// 再 rename 覆盖目标文件，最后 fsync 所在目录，确保崩溃或掉电不会留下一个半截的 blackbox.yml。
 func (s *sidecarService) writeConfigFile(configYaml string) error {
-	err := os.WriteFile(s.configFile, []byte(configYaml), 0o644)
-	if err != nil {
-		return errors.Wrapf(err, "Write config file %q failed", s.configFile)
+	// 重新解析符号链接的原因见 sidecarService.configFile 上的注释。
+	target := s.configFile
+	if resolved, err := filepath.EvalSymlinks(s.configFile); err == nil {
+		target = resolved
+	}
+
+	dir := filepath.Dir(target)
+	tmpFile := filepath.Join(dir, fmt.Sprintf(".%s.tmp-%d", filepath.Base(target), time.Now().UnixNano()))
+
+	writeFile := s.writeFile
+	if writeFile == nil {
+		writeFile = os.WriteFile
+	}
+	rename := s.rename
+	if rename == nil {
+		rename = os.Rename
+	}
+
+	if err := writeFile(tmpFile, []byte(configYaml), 0o644); err != nil {
+		os.Remove(tmpFile)
+		return errors.Wrapf(err, "Write temp config file %q failed", tmpFile)
+	}
+	if err := syncFile(tmpFile); err != nil {
+		os.Remove(tmpFile)
+		return errors.Wrapf(err, "Fsync temp config file %q failed", tmpFile)
+	}
+
+	if err := rename(tmpFile, target); err != nil {
+		os.Remove(tmpFile)
+		return errors.Wrapf(err, "Rename temp config file %q to %q failed", tmpFile, target)
+	}
+
+	if err := syncDir(dir); err != nil {
+		return errors.Wrapf(err, "Fsync config dir %q failed", dir)
 	}
+
 	return nil
 }
 
+// syncFile 打开一个已经写完的文件并 fsync 它的内容，保证数据先于后续的 rename 落盘。
+func syncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncDir fsync 目录本身，确保 rename 产生的目录项变更落盘，而不仅仅是文件内容。
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func (s *sidecarService) doReload(reloadCh chan chan error) error {
 	rc := make(chan error)
 	reloadCh <- rc
@@ -151,3 +493,122 @@ func (s *sidecarService) doReload(reloadCh chan chan error) error {
 	}
 	return nil
 }
+
+// validateModuleYaml 把单个 module 的 YAML 片段包装成一份完整的 Config 文档，单独解码校验，
+// 这样 PutModule 在合并进现有配置前就能拒绝格式错误的 module，而不会污染其它 module。
+func validateModuleYaml(name, moduleYaml string) error {
+	decoder := yaml.NewDecoder(strings.NewReader(wrapModuleYaml(name, moduleYaml)))
+	decoder.KnownFields(true)
+	c := &bbconfig.Config{}
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("error parsing module %q: %s", name, err)
+	}
+	return nil
+}
+
+func wrapModuleYaml(name, moduleYaml string) string {
+	var b strings.Builder
+	b.WriteString("modules:\n  ")
+	b.WriteString(name)
+	b.WriteString(":\n")
+	for _, line := range strings.Split(strings.TrimRight(moduleYaml, "\n"), "\n") {
+		b.WriteString("    ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// putModuleNode 在 configYaml 的 modules 映射下新增或替换 name 对应的节点，基于 yaml.v3 的
+// Node API 而不是先解码成 Go struct 再重新编码，这样未涉及的 module、注释和 key 顺序都能保留。
+func putModuleNode(configYaml, name, moduleYaml string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(configYaml), &doc); err != nil {
+		return "", errors.Wrap(err, "parse current config failed")
+	}
+
+	var moduleDoc yaml.Node
+	if err := yaml.Unmarshal([]byte(moduleYaml), &moduleDoc); err != nil {
+		return "", errors.Wrapf(err, "parse module %q yaml failed", name)
+	}
+	if len(moduleDoc.Content) == 0 {
+		return "", errors.Errorf("module %q yaml must not be blank", name)
+	}
+
+	modulesNode, err := ensureModulesMapping(&doc)
+	if err != nil {
+		return "", err
+	}
+	setMapKey(modulesNode, name, moduleDoc.Content[0])
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal updated config failed")
+	}
+	return string(out), nil
+}
+
+// deleteModuleNode 从 modules 映射下移除 name 对应的节点，changed 为 false 表示该 module 本就
+// 不存在，调用方应当把这种情况当作无操作处理。
+func deleteModuleNode(configYaml, name string) (newConfigYaml string, changed bool, err error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(configYaml), &doc); err != nil {
+		return "", false, errors.Wrap(err, "parse current config failed")
+	}
+
+	modulesNode, err := ensureModulesMapping(&doc)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !deleteMapKey(modulesNode, name) {
+		return configYaml, false, nil
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", false, errors.Wrap(err, "marshal updated config failed")
+	}
+	return string(out), true, nil
+}
+
+// ensureModulesMapping 返回配置文档根节点下 modules 键对应的 mapping 节点，不存在时创建一个空的。
+func ensureModulesMapping(doc *yaml.Node) (*yaml.Node, error) {
+	if len(doc.Content) == 0 {
+		return nil, errors.New("empty config document")
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("config document root must be a mapping")
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "modules" {
+			return root.Content[i+1], nil
+		}
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "modules"}
+	valueNode := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	root.Content = append(root.Content, keyNode, valueNode)
+	return valueNode, nil
+}
+
+func setMapKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	mapping.Content = append(mapping.Content, keyNode, value)
+}
+
+func deleteMapKey(mapping *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -21,6 +21,8 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -194,3 +196,507 @@ modules:
 	}
 
 }
+
+func Test_sidecarService_writeConfigFile_FailWrite(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "prom-config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	configFile := filepath.Join(testDir, "blackbox.yml")
+	oldContent := []byte("modules: {}\n")
+	if err := os.WriteFile(configFile, oldContent, 0o644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := &sidecarService{
+		logger:     log.NewLogfmtLogger(os.Stdout),
+		configFile: configFile,
+		writeFile: func(name string, data []byte, perm os.FileMode) error {
+			return errors.New("injected write failure")
+		},
+		rename: os.Rename,
+	}
+
+	if err := s.writeConfigFile("modules: {}\nnew: true\n"); err == nil {
+		t.Error("writeConfigFile should return err when write fails")
+	}
+
+	got, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, oldContent) {
+		t.Error("writeConfigFile should leave the target file unchanged when write fails")
+	}
+}
+
+func Test_sidecarService_writeConfigFile_FailRename(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "prom-config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	configFile := filepath.Join(testDir, "blackbox.yml")
+	oldContent := []byte("modules: {}\n")
+	if err := os.WriteFile(configFile, oldContent, 0o644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := &sidecarService{
+		logger:     log.NewLogfmtLogger(os.Stdout),
+		configFile: configFile,
+		writeFile:  os.WriteFile,
+		rename: func(oldpath, newpath string) error {
+			return errors.New("injected rename failure")
+		},
+	}
+
+	if err := s.writeConfigFile("modules: {}\nnew: true\n"); err == nil {
+		t.Error("writeConfigFile should return err when rename fails")
+	}
+
+	got, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, oldContent) {
+		t.Error("writeConfigFile should leave the target file unchanged when rename fails")
+	}
+
+	entries, err := os.ReadDir(testDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(entries) != 1 {
+		t.Error("writeConfigFile should clean up the temp file when rename fails")
+	}
+}
+
+func Test_sidecarService_writeConfigFile_NilWriteFileAndRename(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "prom-config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	configFile := filepath.Join(testDir, "blackbox.yml")
+	if err := os.WriteFile(configFile, []byte("modules: {}\n"), 0o644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 和 Test_sidecarService_UpdateConfigReload 一样，只设置 logger/configFile，不设置
+	// writeFile/rename：writeConfigFile 应该退化到 os.WriteFile/os.Rename，而不是 nil 解引用 panic。
+	s := &sidecarService{
+		logger:     log.NewLogfmtLogger(os.Stdout),
+		configFile: configFile,
+	}
+
+	if err := s.writeConfigFile("modules:\n  http_2xx:\n    prober: http\n"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(got), "http_2xx") {
+		t.Error("writeConfigFile should still write through when writeFile/rename are nil")
+	}
+}
+
+func Test_sidecarService_writeConfigFile_Symlink(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "prom-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// 模拟 k8s ConfigMap 挂载：configFile 是一个软链，真正的内容放在一个带版本号的目录里。
+	realDirV1 := filepath.Join(testDir, "..data_v1")
+	if err := os.MkdirAll(realDirV1, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	realFileV1 := filepath.Join(realDirV1, "blackbox.yml")
+	if err := os.WriteFile(realFileV1, []byte("modules: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := filepath.Join(testDir, "blackbox.yml")
+	if err := os.Symlink(realFileV1, configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sidecarService{
+		logger:     log.NewLogfmtLogger(os.Stdout),
+		configFile: configFile,
+		writeFile:  os.WriteFile,
+		rename:     os.Rename,
+	}
+
+	if err := s.writeConfigFile("modules:\n  http_2xx:\n    prober: http\n"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	fi, err := os.Lstat(configFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("writeConfigFile should not replace the symlink itself with a regular file")
+	}
+
+	got, err := os.ReadFile(realFileV1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(got), "http_2xx") {
+		t.Error("writeConfigFile should update the file the symlink points at")
+	}
+
+	// kubelet 把 configFile 重新指向一个新的时间戳目录，模拟 ConfigMap 更新后的符号链接切换。
+	realDirV2 := filepath.Join(testDir, "..data_v2")
+	if err := os.MkdirAll(realDirV2, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	realFileV2 := filepath.Join(realDirV2, "blackbox.yml")
+	if err := os.WriteFile(realFileV2, []byte("modules: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realFileV2, configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.writeConfigFile("modules:\n  tcp_connect:\n    prober: tcp\n"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err = os.ReadFile(realFileV2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(got), "tcp_connect") {
+		t.Error("writeConfigFile should re-resolve the symlink on every call and follow the new target")
+	}
+
+	staleContent, err := os.ReadFile(realFileV1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Contains(string(staleContent), "tcp_connect") {
+		t.Error("writeConfigFile should not keep writing to the stale pre-rotation target")
+	}
+}
+
+func newTestSidecarService(t *testing.T, initialYaml string) *sidecarService {
+	testDir, err := os.MkdirTemp("", "prom-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(testDir) })
+
+	configFile := filepath.Join(testDir, "blackbox.yml")
+	if err := os.WriteFile(configFile, []byte(initialYaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &sidecarService{
+		logger:       log.NewLogfmtLogger(os.Stdout),
+		configFile:   configFile,
+		writeFile:    os.WriteFile,
+		rename:       os.Rename,
+		historyDir:   filepath.Join(testDir, historyDirName),
+		historyDepth: defaultHistoryDepth,
+	}
+}
+
+func alwaysOkReloadCh() chan chan error {
+	reloadCh := make(chan chan error)
+	go func() {
+		for rc := range reloadCh {
+			rc <- nil
+		}
+	}()
+	return reloadCh
+}
+
+func Test_sidecarService_PutModule(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	err := s.PutModule(context.TODO(), "tcp_connect", `
+prober: tcp
+tcp:
+  preferred_ip_protocol: "ip4"
+`, alwaysOkReloadCh())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.readConfigFile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(got, "http_2xx") {
+		t.Error("PutModule should not remove unrelated modules")
+	}
+	if !strings.Contains(got, "tcp_connect") || !strings.Contains(got, "prober: tcp") {
+		t.Error("PutModule should add the new module")
+	}
+}
+
+func Test_sidecarService_PutModule_InvalidYaml(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	err := s.PutModule(context.TODO(), "tcp_connect", "prober: [", alwaysOkReloadCh())
+	if err == nil {
+		t.Error("PutModule should reject a module that fails to parse")
+	}
+}
+
+func Test_sidecarService_DeleteModule(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n  tcp_connect:\n    prober: tcp\n")
+
+	if err := s.DeleteModule(context.TODO(), "tcp_connect", alwaysOkReloadCh()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.readConfigFile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Contains(got, "tcp_connect") {
+		t.Error("DeleteModule should remove the module")
+	}
+	if !strings.Contains(got, "http_2xx") {
+		t.Error("DeleteModule should not touch unrelated modules")
+	}
+}
+
+func Test_sidecarService_DeleteModule_Idempotent(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	if err := s.DeleteModule(context.TODO(), "does_not_exist", alwaysOkReloadCh()); err != nil {
+		t.Error("DeleteModule of an absent module should be a no-op, not an error:", err)
+	}
+}
+
+func Test_sidecarService_PutModule_Concurrent(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	names := []string{"mod_a", "mod_b", "mod_c", "mod_d"}
+	var wg sync.WaitGroup
+	errsCh := make(chan error, len(names))
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errsCh <- s.PutModule(context.TODO(), name, "prober: http\n", alwaysOkReloadCh())
+		}(name)
+	}
+	wg.Wait()
+	close(errsCh)
+
+	for err := range errsCh {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	got, err := s.readConfigFile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, name := range names {
+		if !strings.Contains(got, name) {
+			t.Errorf("PutModule concurrent call for %q did not survive", name)
+		}
+	}
+}
+
+func Test_sidecarService_History_ListGetRollback(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	if len(s.ListRevisions(context.TODO())) != 0 {
+		t.Error("ListRevisions should be empty before any update")
+	}
+
+	cmd := &UpdateConfigCmd{
+		Yaml:   "modules:\n  http_2xx:\n    prober: http\n  tcp_connect:\n    prober: tcp\n",
+		Author: "alice",
+	}
+	if err := s.UpdateConfigReload(context.TODO(), cmd, alwaysOkReloadCh()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	revisions := s.ListRevisions(context.TODO())
+	if len(revisions) != 1 {
+		t.Fatalf("expected 1 revision, got %d", len(revisions))
+	}
+	if revisions[0].Author != "alice" {
+		t.Error("ListRevisions should carry through the UpdateConfigCmd author")
+	}
+
+	firstSha := revisions[0].Sha256
+	firstYaml, err := s.GetRevision(context.TODO(), firstSha)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(firstYaml, "tcp_connect") {
+		t.Error("GetRevision should return the full snapshot content")
+	}
+
+	if err := s.PutModule(context.TODO(), "dns_ok", "prober: dns\n", alwaysOkReloadCh()); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(s.ListRevisions(context.TODO())) != 2 {
+		t.Error("PutModule should append a new revision")
+	}
+
+	if err := s.Rollback(context.TODO(), firstSha, alwaysOkReloadCh()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.readConfigFile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Contains(got, "dns_ok") {
+		t.Error("Rollback should restore the earlier snapshot")
+	}
+	if !strings.Contains(got, "tcp_connect") {
+		t.Error("Rollback should restore the earlier snapshot content")
+	}
+
+	revisionsAfterRollback := s.ListRevisions(context.TODO())
+	if len(revisionsAfterRollback) != 3 {
+		t.Error("Rollback should append a new revision instead of rewriting history")
+	}
+}
+
+func Test_sidecarService_History_Rollback_UnknownRevision(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	if err := s.Rollback(context.TODO(), "deadbeef", alwaysOkReloadCh()); err == nil {
+		t.Error("Rollback should fail for an unknown revision")
+	}
+}
+
+func Test_sidecarService_History_Rollback_ValidatesStoredRevision(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+
+	if err := s.PutModule(context.TODO(), "tcp_connect", "prober: tcp\n", alwaysOkReloadCh()); err != nil {
+		t.Fatal(err)
+	}
+	sha := s.ListRevisions(context.TODO())[0].Sha256
+
+	// 模拟磁盘上的快照文件已经损坏 / 是用更老的 bbconfig schema 写的
+	if err := os.WriteFile(s.revisionFile(sha), []byte("modules:\n  http_2xx:\n    prober: [\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Rollback(context.TODO(), sha, alwaysOkReloadCh()); err == nil {
+		t.Error("Rollback should reject a stored revision that fails config validation")
+	}
+
+	got, err := s.readConfigFile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Contains(got, "prober: [") {
+		t.Error("Rollback should not write an invalid revision to the config file")
+	}
+}
+
+func Test_sidecarService_History_RingBuffer(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+	s.historyDepth = 2
+
+	for i := 0; i < 3; i++ {
+		err := s.PutModule(context.TODO(), fmt.Sprintf("mod_%d", i), "prober: http\n", alwaysOkReloadCh())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	revisions := s.ListRevisions(context.TODO())
+	if len(revisions) != 2 {
+		t.Fatalf("history should be capped at historyDepth, got %d revisions", len(revisions))
+	}
+
+	entries, err := os.ReadDir(s.historyDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 2 条快照 + 1 个 index.json
+	if len(entries) != 3 {
+		t.Errorf("evicted revisions should be removed from disk, found %d entries in history dir", len(entries))
+	}
+}
+
+func Test_sidecarService_History_RollbackUnderEviction(t *testing.T) {
+	s := newTestSidecarService(t, "modules:\n  http_2xx:\n    prober: http\n")
+	s.historyDepth = 2
+
+	// history=[rev1(sha_x), rev2(sha_y)]，正好到达 cap
+	if err := s.PutModule(context.TODO(), "mod_x", "prober: http\n", alwaysOkReloadCh()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutModule(context.TODO(), "mod_y", "prober: http\n", alwaysOkReloadCh()); err != nil {
+		t.Fatal(err)
+	}
+	firstSha := s.ListRevisions(context.TODO())[1].Sha256 // rev1 的 sha_x
+
+	// Rollback(sha_x) 重新提交和 rev1 完全相同的内容 -> 追加 rev3(sha_x)，
+	// 按位置淘汰的是 rev1(sha_x)，但 rev3 还引用着同一个 sha_x 文件。
+	if err := s.Rollback(context.TODO(), firstSha, alwaysOkReloadCh()); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions := s.ListRevisions(context.TODO())
+	if len(revisions) != 2 {
+		t.Fatalf("expected history capped at 2, got %d", len(revisions))
+	}
+	if revisions[0].Sha256 != firstSha {
+		t.Fatalf("expected the rollback revision to reuse sha %q, got %q", firstSha, revisions[0].Sha256)
+	}
+
+	// sha_x 的快照文件必须依然可读：它现在是最新一条记录的内容来源。
+	if _, err := s.GetRevision(context.TODO(), firstSha); err != nil {
+		t.Errorf("GetRevision should still find %q after its position-wise duplicate was evicted: %v", firstSha, err)
+	}
+}